@@ -0,0 +1,229 @@
+package kafka
+
+// Optional CloudEvents support for the kafka handler, following the Kafka protocol
+// binding used by the cloudevents-sdk-go kafka_confluent package: in binary content
+// mode, CloudEvents attributes are carried as ce_* Kafka headers and the event data
+// is the Kafka message value; in structured mode the whole envelope is serialized as
+// JSON in the message value, with only content-type set as a Kafka header.
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CloudEventsMode selects how outgoing target and history messages are encoded.
+type CloudEventsMode int
+
+const (
+	// CloudEventsDisabled produces raw, non-CloudEvents messages (default behavior)
+	CloudEventsDisabled CloudEventsMode = iota
+	// CloudEventsBinary carries CloudEvents attributes as ce_* Kafka headers,
+	// the event data is the Kafka message value
+	CloudEventsBinary
+	// CloudEventsStructured serializes the whole CloudEvents envelope as JSON
+	// in the Kafka message value
+	CloudEventsStructured
+)
+
+const (
+	ceSpecVersionHeader  = "ce_specversion"
+	ceIDHeader           = "ce_id"
+	ceSourceHeader       = "ce_source"
+	ceTypeHeader         = "ce_type"
+	ceSubjectHeader      = "ce_subject"
+	ceTimeHeader         = "ce_time"
+	ceDataContentType    = "ce_datacontenttype"
+	contentTypeHeader    = "content-type"
+	cloudEventsJSONMedia = "application/cloudevents+json"
+
+	// triggeredEventType is the ce_type set on target/history messages produced
+	// from a CloudEvent schedule
+	triggeredEventType = "com.eko.scheduler.triggered"
+)
+
+// WithCloudEvents enables CloudEvents encoding of target and history messages for
+// schedules that are themselves CloudEvents. It has no effect on schedules that are
+// not detected as CloudEvents.
+func WithCloudEvents(mode CloudEventsMode) Option {
+	return func(o *options) {
+		o.cloudEventsMode = mode
+	}
+}
+
+// isCloudEvent detects a CloudEvent by looking for the ce_specversion header (binary
+// mode) or a cloudevents+json content-type (structured mode).
+func isCloudEvent(headers []Header) bool {
+	if _, found := getHeaderValue(headers, ceSpecVersionHeader); found {
+		return true
+	}
+
+	return isStructuredCloudEvent(headers)
+}
+
+// isStructuredCloudEvent reports whether headers carry the structured content mode's
+// content-type, meaning the CloudEvents envelope lives in the message value rather
+// than in ce_* headers.
+func isStructuredCloudEvent(headers []Header) bool {
+	contentType, found := getHeaderValue(headers, contentTypeHeader)
+
+	return found && contentType == cloudEventsJSONMedia
+}
+
+// cloudEventAttributes is the mode-independent set of CloudEvents attributes read
+// from an incoming binary or structured CloudEvent, used to re-encode it in the
+// handler's configured output mode. Extension attributes beyond this set are only
+// preserved when binary-mode input is re-encoded in binary mode (see
+// cloudEventBinaryHeaders); a structured envelope's extensions are not parsed, and
+// structured-mode output carries no extensions.
+type cloudEventAttributes struct {
+	SpecVersion     string
+	ID              string
+	Source          string
+	Subject         string
+	DataContentType string
+	Data            []byte
+}
+
+// binaryCloudEventAttributes reads the canonical CloudEvents attributes from ce_*
+// headers, with the event data being the message value as-is.
+func binaryCloudEventAttributes(headers []Header, value []byte) cloudEventAttributes {
+	specVersion, _ := getHeaderValue(headers, ceSpecVersionHeader)
+	id, _ := getHeaderValue(headers, ceIDHeader)
+	source, _ := getHeaderValue(headers, ceSourceHeader)
+	subject, _ := getHeaderValue(headers, ceSubjectHeader)
+	dataContentType, _ := getHeaderValue(headers, ceDataContentType)
+
+	return cloudEventAttributes{
+		SpecVersion:     specVersion,
+		ID:              id,
+		Source:          source,
+		Subject:         subject,
+		DataContentType: dataContentType,
+		Data:            value,
+	}
+}
+
+// structuredCloudEventAttributes parses the canonical CloudEvents attributes out of a
+// structured-mode JSON envelope, decoding data_base64 when the original event data
+// wasn't JSON.
+func structuredCloudEventAttributes(value []byte) (cloudEventAttributes, error) {
+	var envelope cloudEventEnvelope
+	if err := json.Unmarshal(value, &envelope); err != nil {
+		return cloudEventAttributes{}, fmt.Errorf("invalid cloudevents structured envelope: %v", err)
+	}
+
+	data := []byte(envelope.Data)
+
+	if envelope.DataBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(envelope.DataBase64)
+		if err != nil {
+			return cloudEventAttributes{}, fmt.Errorf("invalid data_base64 in cloudevents structured envelope: %v", err)
+		}
+		data = decoded
+	}
+
+	return cloudEventAttributes{
+		SpecVersion:     envelope.SpecVersion,
+		ID:              envelope.ID,
+		Source:          envelope.Source,
+		Subject:         envelope.Subject,
+		DataContentType: envelope.DataContentType,
+		Data:            data,
+	}, nil
+}
+
+// cloudEventAttributesFrom extracts attrs regardless of whether the incoming
+// CloudEvent used binary or structured content mode.
+func cloudEventAttributesFrom(headers []Header, value []byte) (cloudEventAttributes, error) {
+	if isStructuredCloudEvent(headers) {
+		return structuredCloudEventAttributes(value)
+	}
+
+	return binaryCloudEventAttributes(headers, value), nil
+}
+
+func isCanonicalCEHeader(key string) bool {
+	switch key {
+	case ceSpecVersionHeader, ceIDHeader, ceSourceHeader, ceSubjectHeader, ceDataContentType, ceTimeHeader, ceTypeHeader:
+		return true
+	default:
+		return false
+	}
+}
+
+// cloudEventBinaryHeaders builds the ce_* headers carrying attrs for binary content
+// mode, plus any custom ce_* extension header copied through from originalHeaders
+// (only present when the input itself was binary mode, since structured mode carries
+// no ce_* headers), updating ce_time to now and ce_type to triggeredEventType.
+func cloudEventBinaryHeaders(attrs cloudEventAttributes, originalHeaders []Header, now string) []Header {
+	out := []Header{
+		{Key: ceSpecVersionHeader, Value: []byte(attrs.SpecVersion)},
+		{Key: ceIDHeader, Value: []byte(attrs.ID)},
+		{Key: ceSourceHeader, Value: []byte(attrs.Source)},
+	}
+
+	if attrs.Subject != "" {
+		out = append(out, Header{Key: ceSubjectHeader, Value: []byte(attrs.Subject)})
+	}
+
+	if attrs.DataContentType != "" {
+		out = append(out, Header{Key: ceDataContentType, Value: []byte(attrs.DataContentType)})
+	}
+
+	for _, h := range originalHeaders {
+		if strings.HasPrefix(h.Key, "ce_") && !isCanonicalCEHeader(h.Key) {
+			out = append(out, h)
+		}
+	}
+
+	out = append(out,
+		Header{Key: ceTimeHeader, Value: []byte(now)},
+		Header{Key: ceTypeHeader, Value: []byte(triggeredEventType)},
+	)
+
+	return out
+}
+
+// cloudEventEnvelope is the JSON structured-mode representation of a CloudEvent. Data
+// is only populated when data is itself valid JSON; otherwise the value is carried
+// base64-encoded in DataBase64, per the CloudEvents JSON envelope spec.
+type cloudEventEnvelope struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// cloudEventStructuredValue builds the structured-mode JSON message value for attrs.
+func cloudEventStructuredValue(attrs cloudEventAttributes, now string) ([]byte, error) {
+	envelope := cloudEventEnvelope{
+		SpecVersion:     attrs.SpecVersion,
+		ID:              attrs.ID,
+		Source:          attrs.Source,
+		Type:            triggeredEventType,
+		Subject:         attrs.Subject,
+		Time:            now,
+		DataContentType: attrs.DataContentType,
+	}
+
+	// scheduler payloads are arbitrary bytes (protobuf, plain strings, ...), not
+	// guaranteed to be JSON: embedding non-JSON bytes in Data would make json.Marshal
+	// fail with a syntax error, so fall back to data_base64 whenever data isn't valid
+	// JSON on its own
+	switch {
+	case len(attrs.Data) == 0:
+	case json.Valid(attrs.Data):
+		envelope.Data = attrs.Data
+	default:
+		envelope.DataBase64 = base64.StdEncoding.EncodeToString(attrs.Data)
+	}
+
+	return json.Marshal(envelope)
+}
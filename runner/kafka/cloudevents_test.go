@@ -0,0 +1,198 @@
+package kafka
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func TestCloudEventStructuredValue_JSONData(t *testing.T) {
+	attrs := cloudEventAttributes{
+		SpecVersion: "1.0",
+		ID:          "event-1",
+		Source:      "scheduler",
+		Data:        []byte(`{"foo":"bar"}`),
+	}
+
+	value, err := cloudEventStructuredValue(attrs, "2026-07-27T00:00:00Z")
+	if err != nil {
+		t.Fatalf("cloudEventStructuredValue() error: %v", err)
+	}
+
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(value, &envelope); err != nil {
+		t.Fatalf("unmarshal envelope: %v", err)
+	}
+
+	if _, found := envelope["data_base64"]; found {
+		t.Error("data_base64 should not be set for JSON data")
+	}
+	if data, _ := envelope["data"].(map[string]interface{}); data["foo"] != "bar" {
+		t.Errorf("data = %v, want {foo: bar}", envelope["data"])
+	}
+}
+
+// TestCloudEventStructuredValue_NonJSONData guards against the CloudEvents structured
+// mode bug where a non-JSON payload (protobuf, plain text, ...) made json.Marshal fail
+// because it was assigned directly to the json.RawMessage Data field.
+func TestCloudEventStructuredValue_NonJSONData(t *testing.T) {
+	raw := []byte{0x00, 0x01, 0x02, 'n', 'o', 't', ' ', 'j', 's', 'o', 'n'}
+
+	value, err := cloudEventStructuredValue(cloudEventAttributes{Data: raw}, "2026-07-27T00:00:00Z")
+	if err != nil {
+		t.Fatalf("cloudEventStructuredValue() error: %v", err)
+	}
+
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(value, &envelope); err != nil {
+		t.Fatalf("unmarshal envelope: %v", err)
+	}
+
+	if _, found := envelope["data"]; found {
+		t.Error("data should not be set for non-JSON data")
+	}
+
+	encoded, _ := envelope["data_base64"].(string)
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("decode data_base64: %v", err)
+	}
+	if string(decoded) != string(raw) {
+		t.Errorf("data_base64 decodes to %q, want %q", decoded, raw)
+	}
+}
+
+func TestCloudEventStructuredValue_EmptyData(t *testing.T) {
+	value, err := cloudEventStructuredValue(cloudEventAttributes{}, "2026-07-27T00:00:00Z")
+	if err != nil {
+		t.Fatalf("cloudEventStructuredValue() error: %v", err)
+	}
+
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(value, &envelope); err != nil {
+		t.Fatalf("unmarshal envelope: %v", err)
+	}
+
+	if _, found := envelope["data"]; found {
+		t.Error("data should not be set when data is empty")
+	}
+	if _, found := envelope["data_base64"]; found {
+		t.Error("data_base64 should not be set when data is empty")
+	}
+}
+
+func TestIsCloudEvent(t *testing.T) {
+	cases := []struct {
+		name    string
+		headers []Header
+		want    bool
+	}{
+		{name: "binary", headers: []Header{{Key: ceSpecVersionHeader, Value: []byte("1.0")}}, want: true},
+		{name: "structured", headers: []Header{{Key: contentTypeHeader, Value: []byte(cloudEventsJSONMedia)}}, want: true},
+		{name: "plain content-type", headers: []Header{{Key: contentTypeHeader, Value: []byte("application/json")}}, want: false},
+		{name: "no cloudevents headers", headers: nil, want: false},
+	}
+
+	for _, c := range cases {
+		if got := isCloudEvent(c.headers); got != c.want {
+			t.Errorf("%s: isCloudEvent() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// TestCloudEventAttributesFrom_Structured guards against structured-mode detection
+// and extraction disagreeing: isCloudEvent accepts a structured envelope (by its
+// content-type header), but the attributes it carries live in the JSON body, not in
+// ce_* headers.
+func TestCloudEventAttributesFrom_Structured(t *testing.T) {
+	headers := []Header{{Key: contentTypeHeader, Value: []byte(cloudEventsJSONMedia)}}
+	value := []byte(`{"specversion":"1.0","id":"event-1","source":"scheduler","data":{"foo":"bar"}}`)
+
+	if !isCloudEvent(headers) {
+		t.Fatal("isCloudEvent() should detect the structured envelope")
+	}
+
+	attrs, err := cloudEventAttributesFrom(headers, value)
+	if err != nil {
+		t.Fatalf("cloudEventAttributesFrom() error: %v", err)
+	}
+
+	if attrs.SpecVersion != "1.0" || attrs.ID != "event-1" || attrs.Source != "scheduler" {
+		t.Errorf("attrs = %+v, want specversion/id/source from the envelope body", attrs)
+	}
+	if string(attrs.Data) != `{"foo":"bar"}` {
+		t.Errorf("attrs.Data = %s, want %s", attrs.Data, `{"foo":"bar"}`)
+	}
+}
+
+func TestCloudEventAttributesFrom_StructuredDataBase64(t *testing.T) {
+	headers := []Header{{Key: contentTypeHeader, Value: []byte(cloudEventsJSONMedia)}}
+	encoded := base64.StdEncoding.EncodeToString([]byte("not json"))
+	value := []byte(`{"specversion":"1.0","id":"event-1","source":"scheduler","data_base64":"` + encoded + `"}`)
+
+	attrs, err := cloudEventAttributesFrom(headers, value)
+	if err != nil {
+		t.Fatalf("cloudEventAttributesFrom() error: %v", err)
+	}
+
+	if string(attrs.Data) != "not json" {
+		t.Errorf("attrs.Data = %q, want %q", attrs.Data, "not json")
+	}
+}
+
+func TestCloudEventBinaryHeaders_PreservesExtensionsAndSetsSingleTimestamp(t *testing.T) {
+	attrs := cloudEventAttributes{SpecVersion: "1.0", ID: "event-1", Source: "scheduler"}
+	original := []Header{
+		{Key: ceSpecVersionHeader, Value: []byte("1.0")},
+		{Key: ceIDHeader, Value: []byte("event-1")},
+		{Key: ceSourceHeader, Value: []byte("scheduler")},
+		{Key: "ce_myextension", Value: []byte("custom")},
+	}
+
+	headers := cloudEventBinaryHeaders(attrs, original, "2026-07-27T00:00:00Z")
+
+	ext, found := getHeaderValue(headers, "ce_myextension")
+	if !found || ext != "custom" {
+		t.Errorf("custom ce_* extension header not preserved: %+v", headers)
+	}
+
+	ceTime, found := getHeaderValue(headers, ceTimeHeader)
+	if !found || ceTime != "2026-07-27T00:00:00Z" {
+		t.Errorf("ce_time = %q, want %q", ceTime, "2026-07-27T00:00:00Z")
+	}
+
+	ceType, found := getHeaderValue(headers, ceTypeHeader)
+	if !found || ceType != triggeredEventType {
+		t.Errorf("ce_type = %q, want %q", ceType, triggeredEventType)
+	}
+}
+
+// TestApplyCloudEvents_StructuredModeOnlyKeepsContentType guards against structured
+// mode carrying both the ce_* headers and the same attributes in the JSON body: only
+// content-type stays a header, and the binary input's attributes move into the
+// envelope.
+func TestApplyCloudEvents_StructuredModeOnlyKeepsContentType(t *testing.T) {
+	k := EventHandler{cloudEventsMode: CloudEventsStructured}
+	headers := []Header{
+		{Key: ceSpecVersionHeader, Value: []byte("1.0")},
+		{Key: ceIDHeader, Value: []byte("event-1")},
+		{Key: ceSourceHeader, Value: []byte("scheduler")},
+	}
+
+	outHeaders, outValue, err := k.applyCloudEvents(headers, []byte(`{"foo":"bar"}`))
+	if err != nil {
+		t.Fatalf("applyCloudEvents() error: %v", err)
+	}
+
+	if len(outHeaders) != 1 || outHeaders[0].Key != contentTypeHeader {
+		t.Fatalf("headers = %+v, want only %q", outHeaders, contentTypeHeader)
+	}
+
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(outValue, &envelope); err != nil {
+		t.Fatalf("unmarshal envelope: %v", err)
+	}
+	if envelope["specversion"] != "1.0" || envelope["id"] != "event-1" || envelope["source"] != "scheduler" {
+		t.Errorf("envelope = %+v, want specversion/id/source carried through from the binary headers", envelope)
+	}
+}
@@ -0,0 +1,125 @@
+package kafka
+
+// confluentProducer adapts github.com/confluentinc/confluent-kafka-go to the
+// backend-agnostic Producer interface.
+import (
+	"time"
+
+	confluent "github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+type confluentProducer struct {
+	producer *confluent.Producer
+	events   chan Event
+}
+
+// NewConfluentProducer builds a Producer backed by librdkafka from a full
+// librdkafka configuration (SASL/SSL, OAUTHBEARER, acks, compression.type,
+// linger.ms, enable.idempotence, client.id, statistics callbacks, ...).
+func NewConfluentProducer(configMap *confluent.ConfigMap) (Producer, error) {
+	p, err := confluent.NewProducer(configMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapConfluentProducer(p), nil
+}
+
+// wrapConfluentProducer adapts an already-built *confluent.Producer, letting it be
+// shared with other components (e.g. the transactional producer used by
+// NewTransactionalHandler).
+func wrapConfluentProducer(p *confluent.Producer) *confluentProducer {
+	cp := &confluentProducer{producer: p, events: make(chan Event)}
+
+	go func() {
+		defer close(cp.events)
+		for e := range p.Events() {
+			switch ev := e.(type) {
+			case *confluent.Message:
+				cp.events <- DeliveryReport{Message: deliveredMessage(ev), Error: ev.TopicPartition.Error}
+			case confluent.Error:
+				cp.events <- DeliveryReport{Error: ev}
+			default:
+				// stats, offset-commit and other librdkafka events: forward as-is so
+				// they still reach the handler's own logging instead of being dropped
+				cp.events <- ev
+			}
+		}
+	}()
+
+	return cp
+}
+
+// deliveredMessage rebuilds the full Message (including headers) for a delivery
+// report. librdkafka does not reliably round-trip Headers on the delivery report, so
+// the original Message is stashed in Opaque at Produce time and restored here -
+// this is the confluent-specific version of the old HandlerOpaque header-forwarding
+// hack, now contained inside the adapter instead of the handler.
+func deliveredMessage(ev *confluent.Message) Message {
+	if original, ok := ev.Opaque.(Message); ok {
+		return original
+	}
+
+	topic := ""
+	if ev.TopicPartition.Topic != nil {
+		topic = *ev.TopicPartition.Topic
+	}
+
+	return Message{Topic: topic, Key: ev.Key, Value: ev.Value, Headers: fromConfluentHeaders(ev.Headers)}
+}
+
+func (p *confluentProducer) Produce(msg Message) error {
+	cm := toConfluentMessage(msg)
+	cm.Opaque = msg
+
+	return p.producer.Produce(cm, nil)
+}
+
+func (p *confluentProducer) Flush(timeout time.Duration) int {
+	return p.producer.Flush(int(timeout.Milliseconds()))
+}
+
+func (p *confluentProducer) Close() error {
+	p.producer.Close()
+	return nil
+}
+
+func (p *confluentProducer) Events() <-chan Event {
+	return p.events
+}
+
+func toConfluentHeaders(headers []Header) []confluent.Header {
+	out := make([]confluent.Header, len(headers))
+	for i, h := range headers {
+		out[i] = confluent.Header{Key: h.Key, Value: h.Value}
+	}
+
+	return out
+}
+
+func fromConfluentHeaders(headers []confluent.Header) []Header {
+	out := make([]Header, len(headers))
+	for i, h := range headers {
+		out[i] = Header{Key: h.Key, Value: h.Value}
+	}
+
+	return out
+}
+
+// scheduleHeaders converts a kafka.Schedule's headers (typed []confluent.Header by
+// the schedule/kafka package) to the backend-agnostic Header type, so handler.go does
+// not need to import confluent itself just to read them.
+func scheduleHeaders(headers []confluent.Header) []Header {
+	return fromConfluentHeaders(headers)
+}
+
+func toConfluentMessage(msg Message) *confluent.Message {
+	topic := msg.Topic
+
+	return &confluent.Message{
+		TopicPartition: confluent.TopicPartition{Topic: &topic, Partition: confluent.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        toConfluentHeaders(msg.Headers),
+	}
+}
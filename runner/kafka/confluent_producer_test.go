@@ -0,0 +1,70 @@
+package kafka
+
+import (
+	"testing"
+
+	confluent "github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+func TestToFromConfluentMessage_RoundTrip(t *testing.T) {
+	msg := Message{
+		Topic: "target-topic",
+		Key:   []byte("key-1"),
+		Value: []byte("value-1"),
+		Headers: []Header{
+			{Key: "scheduler-key", Value: []byte("schedule-1")},
+			{Key: "scheduler-topic", Value: []byte("scheduler-topic")},
+		},
+	}
+
+	cm := toConfluentMessage(msg)
+
+	if *cm.TopicPartition.Topic != msg.Topic {
+		t.Errorf("Topic = %q, want %q", *cm.TopicPartition.Topic, msg.Topic)
+	}
+	if string(cm.Key) != string(msg.Key) {
+		t.Errorf("Key = %q, want %q", cm.Key, msg.Key)
+	}
+	if string(cm.Value) != string(msg.Value) {
+		t.Errorf("Value = %q, want %q", cm.Value, msg.Value)
+	}
+
+	got := fromConfluentHeaders(cm.Headers)
+	if len(got) != len(msg.Headers) {
+		t.Fatalf("fromConfluentHeaders() = %+v, want %+v", got, msg.Headers)
+	}
+	for i, h := range got {
+		if h.Key != msg.Headers[i].Key || string(h.Value) != string(msg.Headers[i].Value) {
+			t.Errorf("Headers[%d] = %+v, want %+v", i, h, msg.Headers[i])
+		}
+	}
+}
+
+func TestDeliveredMessage_RestoresFromOpaque(t *testing.T) {
+	original := Message{Topic: "target-topic", Key: []byte("key-1"), Value: []byte("value-1")}
+
+	ev := &confluent.Message{
+		TopicPartition: confluent.TopicPartition{Topic: &original.Topic},
+		Key:            original.Key,
+		Opaque:         original,
+	}
+
+	got := deliveredMessage(ev)
+	if got.Topic != original.Topic || string(got.Key) != string(original.Key) || string(got.Value) != string(original.Value) {
+		t.Errorf("deliveredMessage() = %+v, want %+v", got, original)
+	}
+}
+
+func TestDeliveredMessage_FallsBackWithoutOpaque(t *testing.T) {
+	topic := "target-topic"
+	ev := &confluent.Message{
+		TopicPartition: confluent.TopicPartition{Topic: &topic},
+		Key:            []byte("key-1"),
+		Value:          []byte("value-1"),
+	}
+
+	got := deliveredMessage(ev)
+	if got.Topic != topic || string(got.Key) != "key-1" || string(got.Value) != "value-1" {
+		t.Errorf("deliveredMessage() = %+v, want topic=%q key=key-1 value=value-1", got, topic)
+	}
+}
@@ -5,8 +5,10 @@ package kafka
 // tombstone message (to delete the schedule in the scheduler topic)
 // and log the triggered message in a history topic
 import (
+	"context"
 	"fmt"
 	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -29,108 +31,248 @@ const (
 
 type EventHandler struct {
 	historyTopic string
-	producer     *confluent.Producer
+	// producer is the backend-agnostic production path, see Producer
+	producer Producer
+	// transactional is true when txProducer was configured with a transactional.id,
+	// in which case target, tombstone and history messages are produced atomically
+	// inside a single Kafka transaction instead of relying on the delivery report
+	transactional bool
+	// txProducer is only set in transactional mode: librdkafka transactions are not
+	// part of the backend-agnostic Producer interface, so that path always goes
+	// through the underlying confluent producer directly
+	txProducer *confluent.Producer
+	// cloudEventsMode controls how target/history messages are encoded for schedules
+	// that are themselves CloudEvents, see WithCloudEvents
+	cloudEventsMode      CloudEventsMode
+	logger               log.FieldLogger
+	flushTimeout         time.Duration
+	deliveryErrorHandler func(Message, error)
+	retryPolicy          RetryPolicy
+	deadLetterTopic      string
+	retries              *retryQueue
 }
 
-func NewHandler(bootstrapServers, historyTopic string) (EventHandler, error) {
+// NewHandler builds an EventHandler from a config map holding only
+// bootstrap.servers, keeping the original bootstrapServers/historyTopic parameters.
+// opts are applied after that config map, so a WithConfigMap among them replaces it.
+//
+// Deprecated: use NewHandlerWithOptions with WithConfigMap instead, to also set
+// SASL/SSL, acks, compression.type, or any other librdkafka configuration.
+func NewHandler(bootstrapServers, historyTopic string, opts ...Option) (EventHandler, error) {
 	if bootstrapServers == "" {
 		return EventHandler{}, fmt.Errorf("bootstrapServers input cannot be empty")
 	}
 
+	configMap := WithConfigMap(&confluent.ConfigMap{
+		"bootstrap.servers": bootstrapServers,
+	})
+
+	return NewHandlerWithOptions(historyTopic, append([]Option{configMap}, opts...)...)
+}
+
+// NewHandlerWithOptions builds an EventHandler. The underlying producer is either
+// injected with WithProducer, or created from WithConfigMap (BackendConfluent, the
+// default) or WithSaramaConfig (BackendSarama). At least one of WithProducer/
+// WithConfigMap/WithSaramaConfig must be given; an injected producer takes
+// precedence, otherwise only the selected backend's configuration is used.
+func NewHandlerWithOptions(historyTopic string, opts ...Option) (EventHandler, error) {
 	if historyTopic == "" {
 		return EventHandler{}, fmt.Errorf("historyTopic input cannot be empty")
 	}
 
-	producer, err := confluent.NewProducer(&confluent.ConfigMap{
-		"bootstrap.servers": bootstrapServers,
-	})
+	o := buildOptions(opts)
+
+	producer := o.producer
+	if producer == nil {
+		var err error
+
+		switch o.backend {
+		case BackendSarama:
+			if len(o.saramaBrokers) == 0 {
+				return EventHandler{}, fmt.Errorf("WithSaramaConfig must be provided when using BackendSarama")
+			}
+
+			producer, err = NewSaramaProducer(o.saramaBrokers, o.saramaConfig)
+		default:
+			if o.configMap == nil {
+				return EventHandler{}, fmt.Errorf("either WithConfigMap or WithProducer must be provided")
+			}
+
+			producer, err = NewConfluentProducer(o.configMap)
+		}
+
+		if err != nil {
+			return EventHandler{}, err
+		}
+	}
+
+	return newHandler(historyTopic, producer, nil, o), nil
+}
+
+// NewTransactionalHandler returns an EventHandler producing the target, tombstone and
+// history messages as a single atomic transaction (exactly-once semantics), using
+// librdkafka's transactional producer. This avoids the window, present in
+// NewHandlerWithOptions, where a crash between the target delivery ack and the
+// tombstone/history produce
+// causes the schedule to fire again and loses the history entry.
+//
+// Transactions are a librdkafka-specific feature not exposed by the backend-agnostic
+// Producer interface, so NewTransactionalHandler always uses BackendConfluent
+// regardless of WithBackend/WithSaramaConfig.
+//
+// Consumers reading the scheduler topic (or any topic produced to transactionally)
+// must set isolation.level=read_committed, otherwise they will observe messages from
+// aborted transactions and may re-trigger schedules that were rolled back.
+func NewTransactionalHandler(bootstrapServers, historyTopic, transactionalID string, opts ...Option) (EventHandler, error) {
+	if bootstrapServers == "" {
+		return EventHandler{}, fmt.Errorf("bootstrapServers input cannot be empty")
+	}
+
+	if historyTopic == "" {
+		return EventHandler{}, fmt.Errorf("historyTopic input cannot be empty")
+	}
+
+	if transactionalID == "" {
+		return EventHandler{}, fmt.Errorf("transactionalID input cannot be empty")
+	}
+
+	o := buildOptions(opts)
+
+	configMap := o.configMap
+	if configMap == nil {
+		configMap = &confluent.ConfigMap{}
+	}
+
+	if err := configMap.SetKey("bootstrap.servers", bootstrapServers); err != nil {
+		return EventHandler{}, err
+	}
+
+	if err := configMap.SetKey("transactional.id", transactionalID); err != nil {
+		return EventHandler{}, err
+	}
+
+	txProducer, err := confluent.NewProducer(configMap)
 	if err != nil {
 		return EventHandler{}, err
 	}
 
+	if err := txProducer.InitTransactions(context.Background()); err != nil {
+		return EventHandler{}, fmt.Errorf("unable to init transactions: %v", err)
+	}
+
+	return newHandler(historyTopic, wrapConfluentProducer(txProducer), txProducer, o), nil
+}
+
+func newHandler(historyTopic string, producer Producer, txProducer *confluent.Producer, o *options) EventHandler {
+	transactional := txProducer != nil
+
 	k := EventHandler{
-		historyTopic: historyTopic,
-		producer:     producer,
+		historyTopic:         historyTopic,
+		producer:             producer,
+		transactional:        transactional,
+		txProducer:           txProducer,
+		cloudEventsMode:      o.cloudEventsMode,
+		logger:               o.logger,
+		flushTimeout:         o.flushTimeout,
+		deliveryErrorHandler: o.deliveryErrorHandler,
+		retryPolicy:          o.retryPolicy,
+		deadLetterTopic:      o.deadLetterTopic,
+		retries:              newRetryQueue(),
 	}
 
-	topic := func(msg *confluent.Message) string {
-		return *msg.TopicPartition.Topic
+	notifyDeliveryError := func(msg Message, err error) {
+		k.logger.Errorf("delivery failed: %v", err)
+		if k.deliveryErrorHandler != nil {
+			k.deliveryErrorHandler(msg, err)
+		}
 	}
-	emptyValue := func(msg *confluent.Message) bool {
-		return len(msg.Value) == 0
+
+	handleDeliveryError := func(msg Message, err error) {
+		notifyDeliveryError(msg, err)
+
+		scheduleID := scheduleIDFrom(msg)
+		if key := retryKey(scheduleID, msg); k.retryPolicy.enabled() && k.retries.start(key) {
+			go k.retryLoop(key, scheduleID, msg, err)
+		}
+	}
+
+	// producing the tombstone and history messages from the delivery report is only
+	// done on the non-transactional path, once the target message has been acked; the
+	// transactional path only drains the delivery reports and reports failures
+	if transactional {
+		go func() {
+			defer k.logger.Println("kafka producer stopped")
+			for report := range producer.Events() {
+				dr, ok := report.(DeliveryReport)
+				if !ok {
+					k.logger.Errorf("ignoring event: %v\n", report)
+					continue
+				}
+				if dr.Error == nil {
+					continue
+				}
+
+				// produceTransactional already retries a failed transaction as a
+				// whole, in the background through retryTransaction; an error surfacing here, after a transaction has
+				// committed, cannot be retried through the regular retry queue since
+				// a transactional producer rejects Produce outside an active
+				// transaction, so it is only logged
+				notifyDeliveryError(dr.Message, dr.Error)
+			}
+		}()
+
+		return k
 	}
-	key := func(msg *confluent.Message) string {
-		return string(msg.Key)
+
+	emptyValue := func(msg Message) bool {
+		return len(msg.Value) == 0
 	}
 
 	// kafa producer delivery report go routine
 	go func() {
-		defer log.Println("kafka producer stopped")
-		for e := range producer.Events() {
-			switch ev := e.(type) {
-			case *confluent.Message:
-				if ev.TopicPartition.Error != nil {
-					log.Errorf("delivery failed: %v", ev.TopicPartition.Error)
-					break
+		defer k.logger.Println("kafka producer stopped")
+		for report := range producer.Events() {
+			dr, ok := report.(DeliveryReport)
+			if !ok {
+				k.logger.Errorf("ignoring event: %v\n", report)
+				continue
+			}
+
+			if dr.Error != nil {
+				handleDeliveryError(dr.Message, dr.Error)
+				continue
+			}
+
+			// if not message from history and not a tombstone message, then it is a regular schedule message
+			if dr.Message.Topic != historyTopic && !emptyValue(dr.Message) {
+				err := k.produceTombstoneMessage(dr.Message)
+				if err != nil {
+					k.logger.Errorf("unable to produce tombstone message with id %q: %v\n", string(dr.Message.Key), err)
 				}
-				// if not message from history and not a tombstone message, then it is a regular schedule message
-				if topic(ev) != historyTopic && !emptyValue(ev) {
-					err := k.produceTombstoneMessage(ev)
-					if err != nil {
-						log.Errorf("unable to produce tombstone message with id %q: %v\n", key(ev), err)
-					}
-					err = k.produceHistoryMessage(ev)
-					if err != nil {
-						log.Errorf("unable to produce history message with id %q: %v\n", key(ev), err)
-					}
+				err = k.produceHistoryMessage(dr.Message)
+				if err != nil {
+					k.logger.Errorf("unable to produce history message with id %q: %v\n", string(dr.Message.Key), err)
 				}
-			case confluent.Error:
-				log.Errorf("received an error with code %v: %v\n", ev.Code(), ev)
-			default:
-				log.Errorf("ignoring event: %s\n", ev)
 			}
 		}
 	}()
 
-	return k, nil
+	return k
 }
 
 func (k EventHandler) Close() {
-	defer log.Println("kafka handler closed")
+	defer k.logger.Println("kafka handler closed")
 	defer k.producer.Close()
-	defer k.producer.Flush(flushTimeoutMs)
+	defer k.producer.Flush(k.flushTimeout)
 
-	log.Println("kafka handler closing ...")
+	k.logger.Println("kafka handler closing ...")
 }
 
 func (k EventHandler) String() string {
 	return fmt.Sprintf("kafka handler history_topic=%v\n", k.historyTopic)
 }
 
-// store in a specific topic the triggered messages
-func (k EventHandler) produceHistoryMessage(msg *confluent.Message) error {
-	headers := getHeadersFromOpaque(msg)
-	historyMsg := confluent.Message{
-		TopicPartition: confluent.TopicPartition{Topic: &k.historyTopic, Partition: confluent.PartitionAny},
-		Key:            msg.Key,
-		Value:          msg.Value,
-		Headers:        headers,
-	}
-
-	log.Debugf("producing history message with id %q on topic %q\n", string(msg.Key), k.historyTopic)
-
-	return k.producer.Produce(&historyMsg, nil)
-}
-
-func getHeadersFromOpaque(msg *confluent.Message) []confluent.Header {
-	opaque, ok := msg.Opaque.(HandlerOpaque)
-	if !ok {
-		return nil
-	}
-	return opaque.headers
-}
-
-func getHeaderValue(headers []confluent.Header, key string) (string, bool) {
+func getHeaderValue(headers []Header, key string) (string, bool) {
 	for _, header := range headers {
 		if header.Key == key && len(header.Value) > 0 {
 			return string(header.Value), true
@@ -139,11 +281,23 @@ func getHeaderValue(headers []confluent.Header, key string) (string, bool) {
 	return "", false
 }
 
-func (k EventHandler) produceTombstoneMessage(msg *confluent.Message) error {
-	headers := getHeadersFromOpaque(msg)
+// store in a specific topic the triggered messages
+func (k EventHandler) produceHistoryMessage(msg Message) error {
+	historyMsg := Message{
+		Topic:   k.historyTopic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: msg.Headers,
+	}
+
+	k.logger.Debugf("producing history message with id %q on topic %q\n", string(msg.Key), k.historyTopic)
 
-	originalKey, foundKey := getHeaderValue(headers, OriginalKey)
-	originalTopic, foundTopic := getHeaderValue(headers, OriginalTopic)
+	return k.retryProduce(scheduleIDFrom(msg), historyMsg)
+}
+
+func (k EventHandler) produceTombstoneMessage(msg Message) error {
+	originalKey, foundKey := getHeaderValue(msg.Headers, OriginalKey)
+	originalTopic, foundTopic := getHeaderValue(msg.Headers, OriginalTopic)
 
 	if !foundKey {
 		return fmt.Errorf("cannot find original key in the headers")
@@ -153,90 +307,203 @@ func (k EventHandler) produceTombstoneMessage(msg *confluent.Message) error {
 		return fmt.Errorf("cannot find original topic in the headers")
 	}
 
-	tombstoneMsg := confluent.Message{
-		TopicPartition: confluent.TopicPartition{Topic: &originalTopic, Partition: confluent.PartitionAny},
-		Key:            []byte(originalKey),
+	tombstoneMsg := Message{
+		Topic: originalTopic,
+		Key:   []byte(originalKey),
 		// tombstone is message with nil or empty value
 		Value:   nil,
-		Headers: headers,
+		Headers: msg.Headers,
+	}
+
+	k.logger.Debugf("producing tombstone message with id %q on topic %q\n", originalKey, originalTopic)
+
+	return k.retryProduce(originalKey, tombstoneMsg)
+}
+
+// applyCloudEvents returns the headers and value to use for the target/history
+// messages produced from msg. When CloudEvents support is disabled, or msg is not
+// detected as a CloudEvent, it returns the schedule's own headers/value unchanged.
+// The incoming CloudEvent may itself be binary or structured mode; either way it is
+// re-encoded in the handler's configured CloudEventsMode.
+func (k EventHandler) applyCloudEvents(headers []Header, value []byte) ([]Header, []byte, error) {
+	if k.cloudEventsMode == CloudEventsDisabled || !isCloudEvent(headers) {
+		return headers, value, nil
+	}
+
+	attrs, err := cloudEventAttributesFrom(headers, value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	if k.cloudEventsMode == CloudEventsStructured {
+		ceValue, err := cloudEventStructuredValue(attrs, now)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to build cloudevents structured value: %v", err)
+		}
+
+		// the Kafka protocol binding's structured content mode carries only
+		// content-type as a header, the rest of the attributes live in the envelope
+		return []Header{{Key: contentTypeHeader, Value: []byte(cloudEventsJSONMedia)}}, ceValue, nil
 	}
 
-	log.Debugf("producing tombstone message with id %q on topic %q\n", originalKey, originalTopic)
+	return cloudEventBinaryHeaders(attrs, headers, now), attrs.Data, nil
+}
 
-	return k.producer.Produce(&tombstoneMsg, nil)
+// scheduleFields is the subset of a kafka.Schedule needed to build the target,
+// tombstone and history messages, pulled out into its own plain-data type so that
+// buildMessages can be unit-tested without a concrete kafka.Schedule or
+// *confluent.Producer.
+type scheduleFields struct {
+	Key           []byte
+	Headers       []Header
+	Value         []byte
+	Timestamp     int64
+	OriginalTopic string
+	TargetTopic   string
+	TargetKey     string
 }
 
-// in the confluent go lib, in the delivery channel, the original timestamp and headers
-// are not available, so we need to passt them hrough via the Opaque field
-type HandlerOpaque struct {
-	headers []confluent.Header
+func scheduleFieldsOf(msg kafka.Schedule) scheduleFields {
+	return scheduleFields{
+		Key:           msg.Key,
+		Headers:       scheduleHeaders(msg.Headers),
+		Value:         msg.Value,
+		Timestamp:     msg.Timestamp(),
+		OriginalTopic: *msg.TopicPartition.Topic,
+		TargetTopic:   msg.TargetTopic(),
+		TargetKey:     msg.TargetKey(),
+	}
 }
 
-func (k EventHandler) produceTargetMessage(msg kafka.Schedule) error {
-	headers := append(
-		msg.Headers,
-		confluent.Header{
-			Key:   OriginalTimestamp,
-			Value: []byte(strconv.FormatInt(msg.Timestamp(), 10)),
-		},
-		confluent.Header{
-			Key:   OriginalKey,
-			Value: msg.Key,
-		},
-		confluent.Header{
-			Key:   OriginalTopic,
-			Value: []byte(*msg.TopicPartition.Topic),
-		},
+// buildMessages computes the target, tombstone and history messages produced from a
+// schedule's fields: the CloudEvents-encoded (when enabled) schedule headers and
+// value, plus the scheduler-specific Original* headers added on top.
+func (k EventHandler) buildMessages(f scheduleFields) (target, tombstone, history Message, err error) {
+	headers, value, err := k.applyCloudEvents(f.Headers, f.Value)
+	if err != nil {
+		return Message{}, Message{}, Message{}, err
+	}
+
+	headers = append(
+		headers,
+		Header{Key: OriginalTimestamp, Value: []byte(strconv.FormatInt(f.Timestamp, 10))},
+		Header{Key: OriginalKey, Value: f.Key},
+		Header{Key: OriginalTopic, Value: []byte(f.OriginalTopic)},
 	)
 
-	targetTopic := msg.TargetTopic()
+	target = Message{Topic: f.TargetTopic, Key: []byte(f.TargetKey), Value: value, Headers: headers}
+	tombstone = Message{Topic: f.OriginalTopic, Key: f.Key, Value: nil, Headers: headers}
+	history = Message{Topic: k.historyTopic, Key: []byte(f.TargetKey), Value: value, Headers: headers}
+
+	return target, tombstone, history, nil
+}
+
+func (k EventHandler) produceTargetMessage(msg kafka.Schedule) error {
+	target, _, _, err := k.buildMessages(scheduleFieldsOf(msg))
+	if err != nil {
+		return err
+	}
+
+	k.logger.Debugf("producing target message with id %q on topic %q\n", msg.TargetKey(), target.Topic)
+
+	return k.retryProduce(string(msg.Key), target)
+}
+
+// produceTransactional produces the target, tombstone and history messages inside a
+// single Kafka transaction, directly against txProducer. Unlike produceTargetMessage,
+// it does not need the delivery report round-trip since the original key/topic are
+// already available on msg. If the transaction fails and a RetryPolicy is configured,
+// it is retried as a whole (not message by message, since the three must remain
+// atomic) in the background instead of being dropped.
+func (k EventHandler) produceTransactional(msg kafka.Schedule) error {
+	target, tombstone, history, err := k.buildMessages(scheduleFieldsOf(msg))
+	if err != nil {
+		return err
+	}
 
-	targetMsg := confluent.Message{
-		TopicPartition: confluent.TopicPartition{Topic: &targetTopic, Partition: confluent.PartitionAny},
-		Key:            []byte(msg.TargetKey()),
-		Value:          msg.Value,
-		Headers:        headers,
+	txMsgs := []Message{target, tombstone, history}
+
+	err = k.produceTransaction(txMsgs)
+	if err == nil {
+		k.logger.Debugf("produced target, tombstone and history messages transactionally for id %q\n", msg.TargetKey())
+		return nil
 	}
 
-	// We are setting the headers in the Opaque field because we want them
-	// to be available in the producer.Events() channel.
-	// Today Timestamps and Headers are not available in the producer.Events() delivery report channel
-	targetMsg.Opaque = HandlerOpaque{
-		headers: targetMsg.Headers,
+	scheduleID := string(msg.Key)
+	if !k.retryPolicy.enabled() || !k.retries.start(scheduleID) {
+		return err
 	}
 
-	log.Debugf("producing target message with id %q on topic %q\n", msg.TargetKey(), targetTopic)
+	go k.retryTransaction(scheduleID, txMsgs, err)
+
+	return nil
+}
+
+// produceTransaction runs a single attempt at producing msgs as one Kafka
+// transaction against txProducer, aborting on any failure.
+func (k EventHandler) produceTransaction(msgs []Message) error {
+	if err := k.txProducer.BeginTransaction(); err != nil {
+		return fmt.Errorf("unable to begin transaction: %v", err)
+	}
+
+	for _, m := range msgs {
+		if err := k.txProducer.Produce(toConfluentMessage(m), nil); err != nil {
+			if abortErr := k.txProducer.AbortTransaction(context.Background()); abortErr != nil {
+				k.logger.Errorf("unable to abort transaction: %v", abortErr)
+			}
+			return fmt.Errorf("unable to produce message on topic %q: %v", m.Topic, err)
+		}
+	}
+
+	if err := k.txProducer.CommitTransaction(context.Background()); err != nil {
+		if abortErr := k.txProducer.AbortTransaction(context.Background()); abortErr != nil {
+			k.logger.Errorf("unable to abort transaction: %v", abortErr)
+		}
+		return fmt.Errorf("unable to commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// produce dispatches to the transactional or the delivery-report-based produce path
+// depending on how the handler was constructed.
+func (k EventHandler) produce(msg kafka.Schedule) error {
+	if k.transactional {
+		return k.produceTransactional(msg)
+	}
 
-	return k.producer.Produce(&targetMsg, nil)
+	return k.produceTargetMessage(msg)
 }
 
 func (k EventHandler) Handle(event scheduler.Event) {
 	switch evt := event.(type) {
 	case schedule.InvalidSchedule:
-		log.Debugf("received an InvalidSchedule event: %T %+v errors=%v\n", evt, evt, evt.Errors)
+		k.logger.Debugf("received an InvalidSchedule event: %T %+v errors=%v\n", evt, evt, evt.Errors)
 	case schedule.MissedSchedule:
-		log.Debugf("received a MissedSchedule event: %T %v\n", evt, evt)
+		k.logger.Debugf("received a MissedSchedule event: %T %v\n", evt, evt)
 		msg, ok := evt.Schedule.(kafka.Schedule)
 		if !ok {
-			log.Errorf("event is not a kafka.Schedule: %T %+v\n", event, event)
+			k.logger.Errorf("event is not a kafka.Schedule: %T %+v\n", event, event)
 			break
 		}
-		err := k.produceTargetMessage(msg)
+		err := k.produce(msg)
 		if err != nil {
-			log.Errorf("unable to produce the message: %v %v\n", err, msg)
+			k.logger.Errorf("unable to produce the message: %v %v\n", err, msg)
 		}
 	case schedule.Schedule:
-		log.Printf("received a regular schedule event: %T %v\n", evt, evt)
+		k.logger.Printf("received a regular schedule event: %T %v\n", evt, evt)
 		msg, ok := evt.(kafka.Schedule)
 		if !ok {
-			log.Errorf("event is not a kafka.Schedule: %T %+v\n", event, event)
+			k.logger.Errorf("event is not a kafka.Schedule: %T %+v\n", event, event)
 			break
 		}
-		err := k.produceTargetMessage(msg)
+		err := k.produce(msg)
 		if err != nil {
-			log.Errorf("unable to produce the message: %v %v\n", err, msg)
+			k.logger.Errorf("unable to produce the message: %v %v\n", err, msg)
 		}
 	default:
-		log.Errorf("unexpected event type: %T %v\n", evt, evt)
+		k.logger.Errorf("unexpected event type: %T %v\n", evt, evt)
 	}
 }
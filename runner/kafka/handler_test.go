@@ -0,0 +1,92 @@
+package kafka
+
+import (
+	"strconv"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TestBuildMessages_TargetTombstoneHistoryShapes covers the pure message-shape
+// construction shared by produceTargetMessage and produceTransactional, independent
+// of the concrete kafka.Schedule and *confluent.Producer types.
+func TestBuildMessages_TargetTombstoneHistoryShapes(t *testing.T) {
+	k := EventHandler{historyTopic: "history-topic", logger: log.New()}
+
+	fields := scheduleFields{
+		Key:           []byte("schedule-1"),
+		Headers:       []Header{{Key: "custom", Value: []byte("value")}},
+		Value:         []byte("payload"),
+		Timestamp:     1234,
+		OriginalTopic: "scheduler-topic",
+		TargetTopic:   "target-topic",
+		TargetKey:     "target-key-1",
+	}
+
+	target, tombstone, history, err := k.buildMessages(fields)
+	if err != nil {
+		t.Fatalf("buildMessages() error: %v", err)
+	}
+
+	if target.Topic != fields.TargetTopic || string(target.Key) != fields.TargetKey || string(target.Value) != string(fields.Value) {
+		t.Errorf("target = %+v, want topic=%q key=%q value=%q", target, fields.TargetTopic, fields.TargetKey, fields.Value)
+	}
+
+	if tombstone.Topic != fields.OriginalTopic || string(tombstone.Key) != string(fields.Key) || tombstone.Value != nil {
+		t.Errorf("tombstone = %+v, want topic=%q key=%q value=nil", tombstone, fields.OriginalTopic, fields.Key)
+	}
+
+	if history.Topic != k.historyTopic || string(history.Key) != fields.TargetKey || string(history.Value) != string(fields.Value) {
+		t.Errorf("history = %+v, want topic=%q key=%q value=%q", history, k.historyTopic, fields.TargetKey, fields.Value)
+	}
+
+	for _, msg := range []Message{target, tombstone, history} {
+		timestamp, found := getHeaderValue(msg.Headers, OriginalTimestamp)
+		if !found || timestamp != strconv.FormatInt(fields.Timestamp, 10) {
+			t.Errorf("%s headers missing %s: %+v", msg.Topic, OriginalTimestamp, msg.Headers)
+		}
+		key, found := getHeaderValue(msg.Headers, OriginalKey)
+		if !found || key != string(fields.Key) {
+			t.Errorf("%s headers missing %s: %+v", msg.Topic, OriginalKey, msg.Headers)
+		}
+		topic, found := getHeaderValue(msg.Headers, OriginalTopic)
+		if !found || topic != fields.OriginalTopic {
+			t.Errorf("%s headers missing %s: %+v", msg.Topic, OriginalTopic, msg.Headers)
+		}
+		custom, found := getHeaderValue(msg.Headers, "custom")
+		if !found || custom != "value" {
+			t.Errorf("%s headers dropped original header: %+v", msg.Topic, msg.Headers)
+		}
+	}
+}
+
+// TestBuildMessages_CloudEventsAppliedOnce guards against target and history messages
+// diverging on their CloudEvents encoding: both must carry the exact same re-encoded
+// headers/value, computed once, not re-derived independently per message.
+func TestBuildMessages_CloudEventsAppliedOnce(t *testing.T) {
+	k := EventHandler{historyTopic: "history-topic", logger: log.New(), cloudEventsMode: CloudEventsBinary}
+
+	fields := scheduleFields{
+		Key: []byte("schedule-1"),
+		Headers: []Header{
+			{Key: ceSpecVersionHeader, Value: []byte("1.0")},
+			{Key: ceIDHeader, Value: []byte("event-1")},
+			{Key: ceSourceHeader, Value: []byte("scheduler")},
+		},
+		Value:         []byte("payload"),
+		OriginalTopic: "scheduler-topic",
+		TargetTopic:   "target-topic",
+		TargetKey:     "target-key-1",
+	}
+
+	target, _, history, err := k.buildMessages(fields)
+	if err != nil {
+		t.Fatalf("buildMessages() error: %v", err)
+	}
+
+	targetTime, _ := getHeaderValue(target.Headers, ceTimeHeader)
+	historyTime, _ := getHeaderValue(history.Headers, ceTimeHeader)
+	if targetTime == "" || targetTime != historyTime {
+		t.Errorf("ce_time = target:%q history:%q, want matching, non-empty timestamps", targetTime, historyTime)
+	}
+}
@@ -0,0 +1,125 @@
+package kafka
+
+// Functional options for NewHandler/NewTransactionalHandler, following the same
+// option pattern used by the cloudevents-sdk-go kafka_confluent protocol binding.
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Shopify/sarama"
+	confluent "github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// options holds the configuration assembled from the functional options passed to
+// NewHandler/NewTransactionalHandler, before the EventHandler (and its underlying
+// producer, when not injected) is built.
+type options struct {
+	backend              Backend
+	configMap            *confluent.ConfigMap
+	saramaBrokers        []string
+	saramaConfig         *sarama.Config
+	producer             Producer
+	logger               log.FieldLogger
+	flushTimeout         time.Duration
+	deliveryErrorHandler func(Message, error)
+	cloudEventsMode      CloudEventsMode
+	retryPolicy          RetryPolicy
+	deadLetterTopic      string
+}
+
+// Option configures a handler built via NewHandler or NewTransactionalHandler.
+type Option func(*options)
+
+// buildOptions applies opts on top of the handler defaults.
+func buildOptions(opts []Option) *options {
+	o := &options{
+		logger:       log.StandardLogger(),
+		flushTimeout: flushTimeoutMs * time.Millisecond,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithBackend selects which Producer implementation to build when none is injected
+// with WithProducer. Defaults to BackendConfluent.
+func WithBackend(backend Backend) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
+
+// WithConfigMap sets the full librdkafka producer configuration (SASL/SSL,
+// OAUTHBEARER, acks, compression.type, linger.ms, enable.idempotence, client.id,
+// statistics callbacks, ...) used to build the underlying producer for
+// BackendConfluent, instead of the bootstrap-servers-only default. Ignored if
+// WithProducer is also given.
+func WithConfigMap(configMap *confluent.ConfigMap) Option {
+	return func(o *options) {
+		o.configMap = configMap
+	}
+}
+
+// WithSaramaConfig sets the brokers and sarama configuration used to build the
+// underlying producer for BackendSarama; config may be nil for sarama's defaults.
+// Implies WithBackend(BackendSarama). Ignored if WithProducer is also given.
+func WithSaramaConfig(brokers []string, config *sarama.Config) Option {
+	return func(o *options) {
+		o.backend = BackendSarama
+		o.saramaBrokers = brokers
+		o.saramaConfig = config
+	}
+}
+
+// WithProducer injects a pre-built Producer, letting it be shared with other
+// components instead of one being created from WithConfigMap/WithSaramaConfig. See
+// NewConfluentProducer and NewSaramaProducer to adapt an existing client.
+func WithProducer(producer Producer) Option {
+	return func(o *options) {
+		o.producer = producer
+	}
+}
+
+// WithLogger overrides the logger used by the handler, which defaults to the
+// logrus standard logger.
+func WithLogger(logger log.FieldLogger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithFlushTimeout overrides the duration Close waits for in-flight messages to be
+// delivered, which defaults to flushTimeoutMs.
+func WithFlushTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.flushTimeout = timeout
+	}
+}
+
+// WithDeliveryErrorHandler registers a callback invoked, in addition to the default
+// error log, whenever a produced message fails delivery.
+func WithDeliveryErrorHandler(handler func(Message, error)) Option {
+	return func(o *options) {
+		o.deliveryErrorHandler = handler
+	}
+}
+
+// WithRetry enables retrying failed produces with the given backoff policy instead
+// of dropping them, see RetryPolicy.
+func WithRetry(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicy = policy
+	}
+}
+
+// WithDeadLetterTopic sets the topic messages are routed to once WithRetry's
+// MaxAttempts is exhausted. Without it, exhausted messages are only logged.
+func WithDeadLetterTopic(topic string) Option {
+	return func(o *options) {
+		o.deadLetterTopic = topic
+	}
+}
@@ -0,0 +1,66 @@
+package kafka
+
+// Producer is the backend-agnostic interface EventHandler produces through, so that
+// the non-transactional production path no longer has to import
+// github.com/confluentinc/confluent-kafka-go directly. Two implementations are
+// provided: confluentProducer (the default, backed by librdkafka) and saramaProducer
+// (pure Go, see WithBackend).
+//
+// This is a deliberately partial decoupling: librdkafka transactions (InitTransactions,
+// BeginTransaction, CommitTransaction/AbortTransaction) have no equivalent in sarama and
+// are not part of this interface, so EventHandler's transactional path (see
+// NewTransactionalHandler) still holds a raw *confluent.Producer and calls confluent
+// directly instead of going through Producer.
+import "time"
+
+// Header is a single Kafka message header.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Message is a backend-agnostic Kafka message, produced or received as a delivery
+// report.
+type Message struct {
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers []Header
+}
+
+// Event is anything a Producer may send on its Events() channel. DeliveryReport is
+// the only concrete type defined here; the type stays open so a backend can surface
+// other things without changing the interface, as the confluent backend does by
+// forwarding other librdkafka events (e.g. stats) as-is.
+type Event interface{}
+
+// DeliveryReport reports the outcome of a previously produced Message. Error is nil
+// on successful delivery.
+type DeliveryReport struct {
+	Message Message
+	Error   error
+}
+
+// Producer is the backend-agnostic production interface. Backends are responsible
+// for restoring Message.Headers on the DeliveryReport they emit for a produced
+// message, since not every underlying client library round-trips them.
+type Producer interface {
+	Produce(msg Message) error
+	Flush(timeout time.Duration) int
+	Close() error
+	Events() <-chan Event
+}
+
+// Backend selects which Producer implementation NewHandler builds when none is
+// injected with WithProducer.
+type Backend int
+
+const (
+	// BackendConfluent uses github.com/confluentinc/confluent-kafka-go (cgo,
+	// librdkafka). This is the default.
+	BackendConfluent Backend = iota
+	// BackendSarama uses github.com/Shopify/sarama (pure Go, no cgo), for
+	// cross-compilation, scratch containers and environments where cgo is
+	// disallowed.
+	BackendSarama
+)
@@ -0,0 +1,216 @@
+package kafka
+
+// Retry with exponential backoff and dead-letter routing for produce failures,
+// borrowing from goka's simpleBackoff design: the delay grows by Factor on each
+// attempt, capped at MaxDelay, until MaxAttempts is exhausted, at which point the
+// message is routed to the configured dead-letter topic instead of being dropped.
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DLQReasonHeader carries the error from the last failed produce attempt
+	DLQReasonHeader = "x-scheduler-dlq-reason"
+	// DLQAttemptsHeader carries the number of attempts made before giving up
+	DLQAttemptsHeader = "x-scheduler-dlq-attempts"
+	// DLQOriginalTopicHeader carries the topic the message was originally produced to
+	DLQOriginalTopicHeader = "x-scheduler-dlq-original-topic"
+	// DLQOriginalKeyHeader carries the key the message was originally produced with
+	DLQOriginalKeyHeader = "x-scheduler-dlq-original-key"
+)
+
+// RetryPolicy configures the bounded in-memory retry queue used for produce
+// failures. A zero-value RetryPolicy (MaxAttempts 0) disables retrying.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	Factor       float64
+	MaxDelay     time.Duration
+	MaxAttempts  int
+}
+
+func (p RetryPolicy) enabled() bool {
+	return p.MaxAttempts > 0
+}
+
+// delayFor returns the backoff delay before the given retry attempt (2, 3, ...),
+// growing geometrically from InitialDelay and capped at MaxDelay.
+func (p RetryPolicy) delayFor(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 2; i < attempt; i++ {
+		delay = time.Duration(float64(delay) * p.Factor)
+		if delay > p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+// retryQueue ensures at most one retry sequence runs at a time for a given retry key.
+type retryQueue struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func newRetryQueue() *retryQueue {
+	return &retryQueue{pending: make(map[string]bool)}
+}
+
+func (q *retryQueue) start(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending[key] {
+		return false
+	}
+	q.pending[key] = true
+
+	return true
+}
+
+func (q *retryQueue) done(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.pending, key)
+}
+
+// scheduleIDFrom returns the original schedule key carried in msg's headers,
+// falling back to msg.Key for messages produced directly against the schedule
+// (e.g. a tombstone).
+func scheduleIDFrom(msg Message) string {
+	if id, found := getHeaderValue(msg.Headers, OriginalKey); found {
+		return id
+	}
+	return string(msg.Key)
+}
+
+// retryKey identifies a single produced message for retry/DLQ tracking. A schedule ID
+// alone is not enough: the target, tombstone and history messages for the same
+// schedule are produced back-to-back and all resolve to the same scheduleID, so
+// without the topic a second message failing while the first is already retrying
+// would find the retry queue slot taken and have its error silently dropped instead
+// of retried.
+func retryKey(scheduleID string, msg Message) string {
+	return scheduleID + "|" + msg.Topic
+}
+
+// retryProduce produces msg, and if the first attempt fails and a RetryPolicy is
+// configured, hands it off to a background retry loop with exponential backoff
+// instead of returning the error to the caller. At most one retry sequence runs at
+// a time for a given retryKey(scheduleID, msg).
+func (k EventHandler) retryProduce(scheduleID string, msg Message) error {
+	err := k.producer.Produce(msg)
+	if err == nil {
+		return nil
+	}
+
+	key := retryKey(scheduleID, msg)
+	if !k.retryPolicy.enabled() || !k.retries.start(key) {
+		return err
+	}
+
+	go k.retryLoop(key, scheduleID, msg, err)
+
+	return nil
+}
+
+func (k EventHandler) retryLoop(key, scheduleID string, msg Message, lastErr error) {
+	defer k.retries.done(key)
+
+	for attempt := 2; attempt <= k.retryPolicy.MaxAttempts; attempt++ {
+		delay := k.retryPolicy.delayFor(attempt)
+
+		k.logger.Errorf("produce failed for schedule %q on topic %q, retrying in %v (attempt %d/%d): %v",
+			scheduleID, msg.Topic, delay, attempt, k.retryPolicy.MaxAttempts, lastErr)
+
+		time.Sleep(delay)
+
+		if err := k.producer.Produce(msg); err != nil {
+			lastErr = err
+			continue
+		}
+
+		return
+	}
+
+	k.sendToDeadLetter(scheduleID, msg, k.retryPolicy.MaxAttempts, lastErr)
+}
+
+// sendToDeadLetter routes msg to the configured dead-letter topic, annotated with
+// why and how many attempts were made. If no dead-letter topic is configured, the
+// message is dropped and the failure is only logged.
+func (k EventHandler) sendToDeadLetter(scheduleID string, msg Message, attempts int, lastErr error) {
+	if k.deadLetterTopic == "" {
+		k.logger.Errorf("giving up on schedule %q after %d attempts, no dead-letter topic configured: %v",
+			scheduleID, attempts, lastErr)
+		return
+	}
+
+	// copy instead of appending directly onto msg.Headers: it may share its backing
+	// array with the tombstone/history message built from the same schedule, whose
+	// own retryLoop can be appending DLQ headers onto it concurrently
+	headers := make([]Header, len(msg.Headers), len(msg.Headers)+4)
+	copy(headers, msg.Headers)
+	headers = append(
+		headers,
+		Header{Key: DLQReasonHeader, Value: []byte(lastErr.Error())},
+		Header{Key: DLQAttemptsHeader, Value: []byte(strconv.Itoa(attempts))},
+		Header{Key: DLQOriginalTopicHeader, Value: []byte(msg.Topic)},
+		Header{Key: DLQOriginalKeyHeader, Value: msg.Key},
+	)
+
+	dlqMsg := Message{
+		Topic:   k.deadLetterTopic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
+
+	k.logger.Errorf("giving up on schedule %q after %d attempts, routing to dead-letter topic %q: %v",
+		scheduleID, attempts, k.deadLetterTopic, lastErr)
+
+	// a transactional producer rejects any Produce outside an active transaction, so
+	// the dead letter is produced as its own single-message transaction
+	if err := k.produceDeadLetter(dlqMsg); err != nil {
+		k.logger.Errorf("unable to route schedule %q to dead-letter topic %q: %v", scheduleID, k.deadLetterTopic, err)
+	}
+}
+
+func (k EventHandler) produceDeadLetter(dlqMsg Message) error {
+	if k.transactional {
+		return k.produceTransaction([]Message{dlqMsg})
+	}
+
+	return k.producer.Produce(dlqMsg)
+}
+
+// retryTransaction retries a failed transactional produce with the same backoff
+// policy as retryLoop, running the whole target/tombstone/history transaction again
+// rather than retrying the three messages individually, since they must remain
+// atomic. If attempts are exhausted, all three messages are routed to the
+// dead-letter topic.
+func (k EventHandler) retryTransaction(scheduleID string, msgs []Message, lastErr error) {
+	defer k.retries.done(scheduleID)
+
+	for attempt := 2; attempt <= k.retryPolicy.MaxAttempts; attempt++ {
+		delay := k.retryPolicy.delayFor(attempt)
+
+		k.logger.Errorf("transactional produce failed for schedule %q, retrying in %v (attempt %d/%d): %v",
+			scheduleID, delay, attempt, k.retryPolicy.MaxAttempts, lastErr)
+
+		time.Sleep(delay)
+
+		if err := k.produceTransaction(msgs); err != nil {
+			lastErr = err
+			continue
+		}
+
+		return
+	}
+
+	for _, msg := range msgs {
+		k.sendToDeadLetter(scheduleID, msg, k.retryPolicy.MaxAttempts, lastErr)
+	}
+}
@@ -0,0 +1,104 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_delayFor(t *testing.T) {
+	policy := RetryPolicy{
+		InitialDelay: 100 * time.Millisecond,
+		Factor:       2,
+		MaxDelay:     1 * time.Second,
+		MaxAttempts:  10,
+	}
+
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 2, want: 100 * time.Millisecond},
+		{attempt: 3, want: 200 * time.Millisecond},
+		{attempt: 4, want: 400 * time.Millisecond},
+		{attempt: 5, want: 800 * time.Millisecond},
+		// capped at MaxDelay once the geometric growth exceeds it
+		{attempt: 6, want: 1 * time.Second},
+		{attempt: 7, want: 1 * time.Second},
+	}
+
+	for _, c := range cases {
+		if got := policy.delayFor(c.attempt); got != c.want {
+			t.Errorf("delayFor(%d) = %v, want %v", c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicy_enabled(t *testing.T) {
+	if (RetryPolicy{}).enabled() {
+		t.Error("zero-value RetryPolicy should be disabled")
+	}
+	if !(RetryPolicy{MaxAttempts: 1}).enabled() {
+		t.Error("RetryPolicy with MaxAttempts > 0 should be enabled")
+	}
+}
+
+func TestRetryQueue_start(t *testing.T) {
+	q := newRetryQueue()
+
+	if !q.start("a") {
+		t.Fatal("first start for a new key should succeed")
+	}
+	if q.start("a") {
+		t.Fatal("start for a key already pending should fail")
+	}
+	if !q.start("b") {
+		t.Fatal("start for a different key should succeed even while a is pending")
+	}
+
+	q.done("a")
+	if !q.start("a") {
+		t.Fatal("start should succeed again once the key is done")
+	}
+}
+
+func TestScheduleIDFrom(t *testing.T) {
+	withOriginalKey := Message{
+		Key:     []byte("target-key"),
+		Headers: []Header{{Key: OriginalKey, Value: []byte("schedule-1")}},
+	}
+	if got := scheduleIDFrom(withOriginalKey); got != "schedule-1" {
+		t.Errorf("scheduleIDFrom() = %q, want %q", got, "schedule-1")
+	}
+
+	withoutOriginalKey := Message{Key: []byte("schedule-2")}
+	if got := scheduleIDFrom(withoutOriginalKey); got != "schedule-2" {
+		t.Errorf("scheduleIDFrom() fallback = %q, want %q", got, "schedule-2")
+	}
+}
+
+// TestRetryKeyDistinguishesMessagesForSameSchedule guards against the retry queue
+// collision bug where the target, tombstone and history messages of the same
+// schedule share a scheduleID and a second failure was silently dropped because the
+// first failure's retry slot was already taken.
+func TestRetryKeyDistinguishesMessagesForSameSchedule(t *testing.T) {
+	scheduleID := "schedule-1"
+	target := Message{Topic: "target-topic"}
+	tombstone := Message{Topic: "scheduler-topic"}
+	history := Message{Topic: "history-topic"}
+
+	q := newRetryQueue()
+
+	if !q.start(retryKey(scheduleID, target)) {
+		t.Fatal("starting retry for the target message should succeed")
+	}
+	if !q.start(retryKey(scheduleID, tombstone)) {
+		t.Fatal("starting retry for the tombstone message should succeed even though the target retry is in flight")
+	}
+	if !q.start(retryKey(scheduleID, history)) {
+		t.Fatal("starting retry for the history message should succeed even though other retries for the same schedule are in flight")
+	}
+
+	if q.start(retryKey(scheduleID, target)) {
+		t.Fatal("starting a second retry for the same message should still fail")
+	}
+}
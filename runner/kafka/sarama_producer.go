@@ -0,0 +1,122 @@
+package kafka
+
+// saramaProducer adapts github.com/Shopify/sarama (pure Go, no cgo) to the
+// backend-agnostic Producer interface, as an alternative to confluentProducer for
+// cross-compilation, scratch containers and environments where cgo is disallowed.
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type saramaProducer struct {
+	producer sarama.AsyncProducer
+	events   chan Event
+}
+
+// NewSaramaProducer builds a Producer backed by sarama. config may be nil, in which
+// case sarama.NewConfig() defaults are used; Return.Successes/Return.Errors are
+// always forced on since delivery reports are required to drive tombstone/history
+// production and retries.
+func NewSaramaProducer(brokers []string, config *sarama.Config) (Producer, error) {
+	if config == nil {
+		config = sarama.NewConfig()
+	}
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &saramaProducer{producer: producer, events: make(chan Event)}
+
+	go sp.dispatch()
+
+	return sp, nil
+}
+
+// dispatch forwards both the Successes and the Errors channel until they are both
+// closed. sarama does not close them in lockstep on shutdown, so a naive select
+// returning on the first closed channel can drop delivery reports still pending on
+// the other one.
+func (p *saramaProducer) dispatch() {
+	defer close(p.events)
+
+	successes := p.producer.Successes()
+	errors := p.producer.Errors()
+
+	for successes != nil || errors != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			p.events <- DeliveryReport{Message: fromSaramaMessage(msg)}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			p.events <- DeliveryReport{Message: fromSaramaMessage(err.Msg), Error: err.Err}
+		}
+	}
+}
+
+func (p *saramaProducer) Produce(msg Message) error {
+	p.producer.Input() <- toSaramaMessage(msg)
+	return nil
+}
+
+// Flush is a no-op: sarama's AsyncProducer has no explicit flush call, Close already
+// blocks until in-flight messages are delivered.
+func (p *saramaProducer) Flush(timeout time.Duration) int {
+	return 0
+}
+
+func (p *saramaProducer) Close() error {
+	return p.producer.Close()
+}
+
+func (p *saramaProducer) Events() <-chan Event {
+	return p.events
+}
+
+func toSaramaMessage(msg Message) *sarama.ProducerMessage {
+	headers := make([]sarama.RecordHeader, len(msg.Headers))
+	for i, h := range msg.Headers {
+		headers[i] = sarama.RecordHeader{Key: []byte(h.Key), Value: h.Value}
+	}
+
+	pm := &sarama.ProducerMessage{
+		Topic:   msg.Topic,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Headers: headers,
+	}
+
+	// a nil value is a tombstone; sarama.ByteEncoder(nil) would instead encode to
+	// an empty (non-null) value, so leave pm.Value unset in that case
+	if msg.Value != nil {
+		pm.Value = sarama.ByteEncoder(msg.Value)
+	}
+
+	return pm
+}
+
+func fromSaramaMessage(msg *sarama.ProducerMessage) Message {
+	headers := make([]Header, len(msg.Headers))
+	for i, h := range msg.Headers {
+		headers[i] = Header{Key: string(h.Key), Value: h.Value}
+	}
+
+	var value []byte
+	if msg.Value != nil {
+		value, _ = msg.Value.Encode()
+	}
+
+	key, _ := msg.Key.Encode()
+
+	return Message{Topic: msg.Topic, Key: key, Value: value, Headers: headers}
+}
@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestToFromSaramaMessage_RoundTrip(t *testing.T) {
+	msg := Message{
+		Topic: "target-topic",
+		Key:   []byte("key-1"),
+		Value: []byte("value-1"),
+		Headers: []Header{
+			{Key: "scheduler-key", Value: []byte("schedule-1")},
+			{Key: "scheduler-topic", Value: []byte("scheduler-topic")},
+		},
+	}
+
+	pm := toSaramaMessage(msg)
+
+	if pm.Topic != msg.Topic {
+		t.Errorf("Topic = %q, want %q", pm.Topic, msg.Topic)
+	}
+
+	// sarama.ProducerMessage is only fully populated once handed to an
+	// AsyncProducer, but the encoders are already resolvable for a message we built
+	// ourselves
+	key, err := pm.Key.Encode()
+	if err != nil {
+		t.Fatalf("Key.Encode() error: %v", err)
+	}
+	if string(key) != string(msg.Key) {
+		t.Errorf("Key = %q, want %q", key, msg.Key)
+	}
+
+	value, err := pm.Value.Encode()
+	if err != nil {
+		t.Fatalf("Value.Encode() error: %v", err)
+	}
+	if string(value) != string(msg.Value) {
+		t.Errorf("Value = %q, want %q", value, msg.Value)
+	}
+
+	got := fromSaramaMessage(pm)
+	if got.Topic != msg.Topic || string(got.Key) != string(msg.Key) || string(got.Value) != string(msg.Value) {
+		t.Errorf("fromSaramaMessage() = %+v, want %+v", got, msg)
+	}
+	if len(got.Headers) != len(msg.Headers) {
+		t.Fatalf("fromSaramaMessage() Headers = %+v, want %+v", got.Headers, msg.Headers)
+	}
+	for i, h := range got.Headers {
+		if h.Key != msg.Headers[i].Key || string(h.Value) != string(msg.Headers[i].Value) {
+			t.Errorf("Headers[%d] = %+v, want %+v", i, h, msg.Headers[i])
+		}
+	}
+}
+
+func TestToSaramaMessage_TombstoneHasNilValue(t *testing.T) {
+	msg := Message{Topic: "scheduler-topic", Key: []byte("key-1"), Value: nil}
+
+	pm := toSaramaMessage(msg)
+
+	if pm.Value != nil {
+		t.Errorf("Value = %v, want nil for a tombstone message", pm.Value)
+	}
+}
+
+func TestFromSaramaMessage_NilValue(t *testing.T) {
+	pm := &sarama.ProducerMessage{Topic: "scheduler-topic", Key: sarama.ByteEncoder("key-1")}
+
+	got := fromSaramaMessage(pm)
+
+	if got.Value != nil {
+		t.Errorf("Value = %v, want nil", got.Value)
+	}
+}